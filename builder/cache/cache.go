@@ -0,0 +1,168 @@
+// Package cache implements a content-addressable cache for the build
+// engine: each build step is looked up by a digest of its inputs (the
+// parent image, the canonicalized instruction, and, for ADD/COPY, the
+// exact bytes and modes being added) rather than by parent-image-ID plus
+// raw command string. This makes cache hits independent of incidental
+// differences between working trees, such as file mtimes.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Backend persists the digest -> image ID mapping. The default Store backs
+// onto an in-process map; a caller that wants the mapping to survive
+// restarts (eg. one backed by the graph driver's metadata store) can supply
+// its own Backend.
+type Backend interface {
+	Get(digest string) (imageID string, ok bool)
+	Set(digest, imageID string)
+	// All returns every digest -> imageID mapping currently known, for
+	// export to a remote cache.
+	All() map[string]string
+}
+
+// mapBackend is the default, in-memory Backend.
+type mapBackend struct {
+	mu    sync.Mutex
+	index map[string]string
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{index: make(map[string]string)}
+}
+
+func (b *mapBackend) Get(digest string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	imageID, ok := b.index[digest]
+	return imageID, ok
+}
+
+func (b *mapBackend) Set(digest, imageID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.index[digest] = imageID
+}
+
+func (b *mapBackend) All() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := make(map[string]string, len(b.index))
+	for k, v := range b.index {
+		all[k] = v
+	}
+	return all
+}
+
+// Store maps a step digest to the image ID it previously produced.
+type Store struct {
+	backend Backend
+}
+
+// New returns a Store backed by an in-memory map.
+func New() *Store {
+	return &Store{backend: newMapBackend()}
+}
+
+// NewWithBackend returns a Store backed by the given Backend, eg. one that
+// persists the digest map alongside the graph driver's own metadata.
+func NewWithBackend(backend Backend) *Store {
+	return &Store{backend: backend}
+}
+
+// Lookup returns the image ID previously committed for digest, if any.
+func (s *Store) Lookup(digest string) (imageID string, ok bool) {
+	return s.backend.Get(digest)
+}
+
+// Set records that digest produced imageID.
+func (s *Store) Set(digest, imageID string) {
+	s.backend.Set(digest, imageID)
+}
+
+// Entries returns every digest -> imageID mapping currently known to the
+// store.
+func (s *Store) Entries() map[string]string {
+	return s.backend.All()
+}
+
+// StepDigest computes the content-addressable key for a single build step:
+// a SHA-256 digest over the parent image ID, the canonicalized instruction,
+// and (for ADD/COPY steps) the merkle digest of the files being added.
+func StepDigest(parentImageID, instruction, fileDigest string) string {
+	h := sha256.New()
+	io.WriteString(h, parentImageID)
+	io.WriteString(h, "\x00")
+	io.WriteString(h, instruction)
+	io.WriteString(h, "\x00")
+	io.WriteString(h, fileDigest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FileDigest computes a merkle-style digest over the exact bytes and modes
+// of the file or directory tree at path, independent of mtimes. Identical
+// content at the same relative paths always yields the same digest, even
+// across different working trees.
+func FileDigest(root string) (string, error) {
+	return FileDigestFiltered(root, nil)
+}
+
+// FileDigestFiltered is like FileDigest, but skips any entry (file or
+// directory) for which skip(relPath, isDir) returns true, eg. paths
+// excluded by a .dockerignore. Skipped paths never influence the resulting
+// digest, so build cache invalidation doesn't depend on ignored files.
+func FileDigestFiltered(root string, skip func(relPath string, isDir bool) bool) (string, error) {
+	var entries []string
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fh := sha256.New()
+		if _, err := io.Copy(fh, f); err != nil {
+			return err
+		}
+
+		entries = append(entries, hex.EncodeToString(fh.Sum(nil))+" "+info.Mode().String()+" "+filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(entries)
+
+	h := sha256.New()
+	for _, entry := range entries {
+		io.WriteString(h, entry)
+		io.WriteString(h, "\n")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ManifestEntry describes one cached build step as stored in a remote cache.
+type ManifestEntry struct {
+	Digest  string `json:"digest"`
+	ImageID string `json:"imageId"`
+	// ParentDigest is the digest of the step this one was built on top of,
+	// if any, so a client can walk the chain and fetch only the layers it
+	// is missing instead of the whole history.
+	ParentDigest string `json:"parentDigest,omitempty"`
+}
+
+// Manifest is the wire format exchanged with a remote build cache: the set
+// of known digest -> imageID mappings. The referenced image layers are
+// uploaded/downloaded alongside it as separate tarballs, named by imageID.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// EncodeManifest serializes m as JSON.
+func EncodeManifest(w io.Writer, m Manifest) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+// DecodeManifest parses a JSON-encoded Manifest.
+func DecodeManifest(r io.Reader) (Manifest, error) {
+	var m Manifest
+	err := json.NewDecoder(r).Decode(&m)
+	return m, err
+}
+
+// Export snapshots the store's digest -> imageID mappings into a Manifest.
+// parentOf supplies the parent digest to record against each entry, if
+// known, so a remote consumer can reconstruct the dependency chain.
+func (s *Store) Export(parentOf map[string]string) Manifest {
+	var m Manifest
+	for digest, imageID := range s.Entries() {
+		m.Entries = append(m.Entries, ManifestEntry{
+			Digest:       digest,
+			ImageID:      imageID,
+			ParentDigest: parentOf[digest],
+		})
+	}
+	return m
+}
+
+// Import merges every entry of m into the store.
+func (s *Store) Import(m Manifest) {
+	for _, e := range m.Entries {
+		s.Set(e.Digest, e.ImageID)
+	}
+}
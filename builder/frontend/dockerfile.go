@@ -0,0 +1,40 @@
+package frontend
+
+import "strings"
+
+func init() {
+	Register("dockerfile", &dockerfileFrontend{})
+}
+
+// dockerfileFrontend is the default, shell-style `FROM/RUN/ADD/...` syntax.
+type dockerfileFrontend struct{}
+
+func (*dockerfileFrontend) Parse(spec []byte) ([]Op, error) {
+	var ops []Op
+	raw := strings.Replace(string(spec), "\r\n", "\n", -1)
+
+	var current string
+	for _, rawLine := range strings.Split(raw, "\n") {
+		if strings.HasSuffix(strings.TrimRight(rawLine, " \t"), "\\") {
+			trimmed := strings.TrimRight(rawLine, " \t")
+			current += strings.TrimSuffix(trimmed, "\\")
+			continue
+		}
+		current += rawLine
+
+		line := strings.TrimSpace(current)
+		current = ""
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		instruction := strings.ToLower(strings.TrimSpace(fields[0]))
+		args := ""
+		if len(fields) == 2 {
+			args = strings.TrimSpace(fields[1])
+		}
+		ops = append(ops, Op{Instruction: instruction, Args: args})
+	}
+	return ops, nil
+}
@@ -0,0 +1,49 @@
+// Package frontend decouples the build engine from any one Dockerfile
+// syntax. A BuildFrontend turns the raw bytes of a build spec into a
+// normalized sequence of Ops that the engine can execute without caring
+// whether they came from a shell-style Dockerfile, JSON, or HCL.
+package frontend
+
+import "fmt"
+
+// Op is one normalized build instruction, e.g. {Instruction: "run", Args: "make"}.
+type Op struct {
+	Instruction string
+	Args        string
+}
+
+// BuildFrontend turns the contents of a build spec file into a sequence of Ops.
+type BuildFrontend interface {
+	// Parse returns the Ops described by spec, in execution order.
+	Parse(spec []byte) ([]Op, error)
+}
+
+var frontends = map[string]BuildFrontend{}
+
+// Register makes a BuildFrontend available under name, for later lookup
+// by filename or by explicit selection (eg. from the build API).
+func Register(name string, f BuildFrontend) {
+	frontends[name] = f
+}
+
+// Lookup returns the frontend registered under name.
+func Lookup(name string) (BuildFrontend, error) {
+	f, exists := frontends[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown build frontend: %s", name)
+	}
+	return f, nil
+}
+
+// DetectByFilename picks a registered frontend based on the conventional
+// name of the build spec file found in the build context.
+func DetectByFilename(name string) (BuildFrontend, error) {
+	switch name {
+	case "Dockerfile":
+		return Lookup("dockerfile")
+	case "Dockerfile.json":
+		return Lookup("json")
+	default:
+		return nil, fmt.Errorf("no frontend registered for build spec %q", name)
+	}
+}
@@ -0,0 +1,32 @@
+package frontend
+
+import "encoding/json"
+
+func init() {
+	Register("json", &jsonFrontend{})
+}
+
+// jsonOp mirrors Op, with exported JSON field names so build specs can be
+// generated programmatically instead of string-templating a Dockerfile.
+type jsonOp struct {
+	Instruction string `json:"instruction"`
+	Args        string `json:"args"`
+}
+
+// jsonFrontend accepts `{"steps": [{"instruction": "from", "args": "..."}, ...]}`
+// as a structured alternative to the shell-style Dockerfile syntax.
+type jsonFrontend struct{}
+
+func (*jsonFrontend) Parse(spec []byte) ([]Op, error) {
+	var doc struct {
+		Steps []jsonOp `json:"steps"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+	ops := make([]Op, 0, len(doc.Steps))
+	for _, step := range doc.Steps {
+		ops = append(ops, Op{Instruction: step.Instruction, Args: step.Args})
+	}
+	return ops, nil
+}
@@ -0,0 +1,1071 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/builder/cache"
+	"github.com/dotcloud/docker/builder/frontend"
+	"github.com/dotcloud/docker/dockerignore"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/runconfig"
+	"github.com/dotcloud/docker/utils"
+)
+
+var ErrDockerfileEmpty = fmt.Errorf("Dockerfile cannot be empty")
+
+// BuildFile drives the execution of a single `docker build`. It parses a
+// Dockerfile found in a build context, executes each instruction against a
+// temporary container, and commits the result of each step so later steps
+// (and later builds, via the cache) can reuse it.
+type BuildFile interface {
+	Build(archive.Archive) (string, error)
+	CmdFrom(string) error
+	CmdMaintainer(string) error
+
+	// ImportCache merges a remote HTTP build cache (see builder/cache)
+	// into this build's cache, first fetching every referenced image
+	// layer that is missing locally.
+	ImportCache(url string) error
+	// ExportCache pushes this build's cache, and the layers it
+	// references, to a remote HTTP endpoint.
+	ExportCache(url string) error
+
+	// SetTarget restricts the build to stop once the named stage has
+	// been committed, instead of running to the end of the Dockerfile.
+	SetTarget(name string)
+}
+
+type buildFile struct {
+	runtime *Runtime
+	srv     *Server
+
+	image      string
+	maintainer string
+	config     *runconfig.Config
+
+	context     string
+	contextPath string
+
+	verbose      bool
+	utilizeCache bool
+	rm           bool
+
+	authConfig *registry.AuthConfig
+	configFile *registry.ConfigFile
+
+	tmpContainers map[string]struct{}
+	tmpImages     map[string]struct{}
+
+	outStream io.Writer
+	errStream io.Writer
+
+	cmdSet bool
+
+	sf *utils.StreamFormatter
+
+	// Target, when set, stops the build after the named stage has been
+	// committed instead of running to the end of the Dockerfile.
+	Target string
+
+	// targetReached is set once the FROM for the Target stage has been
+	// dispatched, and checked just before the next stage's FROM runs, so
+	// the Target stage's own instructions still execute before the build
+	// stops.
+	targetReached bool
+
+	// stageImages maps a stage name (or its positional index) to the
+	// image ID produced by that stage's FROM/last instruction, so that
+	// later stages can `COPY --from=<stage>` out of it.
+	stageImages map[string]string
+
+	// stageIndex tracks how many FROM instructions (stages) have been
+	// seen so far, so that `AS` is optional and stages can also be
+	// addressed positionally (`--from=0`).
+	stageIndex int
+
+	// cacheStore maps a step's content digest (see builder/cache) to the
+	// image ID it previously produced, so identical steps hit the cache
+	// even across different working trees.
+	cacheStore *cache.Store
+
+	// parentDigest records, for every digest committed so far, the digest
+	// of the step it was built on top of. ExportCache uses this to let a
+	// remote consumer reconstruct the dependency chain.
+	parentDigest map[string]string
+
+	// lastDigest is the digest of the most recently committed step.
+	lastDigest string
+
+	// ignorePatterns holds the gitignore-style patterns read from the
+	// build context's .dockerignore, if any. Files they match are
+	// excluded from ADD/COPY and never influence the cache digest.
+	ignorePatterns []string
+
+	// progress, if set, receives a BuildProgressEvent for every step.
+	progress ProgressReporter
+
+	// lastCacheHitDigest is set by probeCache when the step currently
+	// being dispatched was served from cache, and cleared before each
+	// step, so Build() can report it on the resulting event.
+	lastCacheHitDigest string
+}
+
+// reportProgress forwards event to the configured ProgressReporter, if any,
+// silently dropping any error it returns: a broken progress consumer must
+// never fail the build.
+func (b *buildFile) reportProgress(event BuildProgressEvent) {
+	if b.progress == nil {
+		return
+	}
+	b.progress.Report(event)
+}
+
+// stepEvent builds the BuildProgressEvent common to all three states a step
+// can report (started, error, complete); callers fill in the fields that
+// vary by state (ErrorMessage, or CachedFromDigest/ResultImageID).
+func (b *buildFile) stepEvent(step, total int, instruction, status string, startedAt time.Time) BuildProgressEvent {
+	return BuildProgressEvent{
+		Step: step, Total: total, Instruction: instruction,
+		Status: status, StartedAt: startedAt, DurationMs: int64(time.Since(startedAt) / time.Millisecond),
+	}
+}
+
+func (b *buildFile) clearTmp(containers map[string]struct{}) {
+	for c := range containers {
+		tmp := b.runtime.Get(c)
+		if err := b.runtime.Destroy(tmp); err != nil {
+			fmt.Fprintf(b.outStream, "Error removing intermediate container %s: %s\n", utils.TruncateID(c), err)
+		} else {
+			delete(containers, c)
+			fmt.Fprintf(b.outStream, "Removing intermediate container %s\n", utils.TruncateID(c))
+		}
+	}
+}
+
+// dispatchers maps a lower-cased Dockerfile instruction to the method that
+// implements it.
+var dispatchers = map[string]func(*buildFile, string) error{
+	"from":       (*buildFile).CmdFrom,
+	"maintainer": (*buildFile).CmdMaintainer,
+	"run":        (*buildFile).CmdRun,
+	"env":        (*buildFile).CmdEnv,
+	"cmd":        (*buildFile).CmdCmd,
+	"entrypoint": (*buildFile).CmdEntrypoint,
+	"expose":     (*buildFile).CmdExpose,
+	"volume":     (*buildFile).CmdVolume,
+	"user":       (*buildFile).CmdUser,
+	"workdir":    (*buildFile).CmdWorkdir,
+	"add":        (*buildFile).CmdAdd,
+	"copy":       (*buildFile).CmdCopy,
+}
+
+// Build reads a Dockerfile out of context, executes it line by line, and
+// returns the ID of the image produced by the last instruction run (or, if
+// Target is set, by the last instruction of the named stage).
+func (b *buildFile) Build(context archive.Archive) (string, error) {
+	tmpdirPath, err := ioutil.TempDir("", "docker-build")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdirPath)
+
+	if err := archive.Untar(context, tmpdirPath, nil); err != nil {
+		return "", err
+	}
+
+	b.context = tmpdirPath
+	b.contextPath = tmpdirPath
+
+	if ignoreFile, err := os.Open(path.Join(tmpdirPath, ".dockerignore")); err == nil {
+		patterns, err := dockerignore.ReadAll(ignoreFile)
+		ignoreFile.Close()
+		if err != nil {
+			return "", err
+		}
+		b.ignorePatterns = patterns
+	}
+
+	specName := "Dockerfile"
+	if _, err := os.Stat(path.Join(tmpdirPath, "Dockerfile.json")); err == nil {
+		specName = "Dockerfile.json"
+	}
+	fe, err := frontend.DetectByFilename(specName)
+	if err != nil {
+		return "", err
+	}
+
+	fileBytes, err := ioutil.ReadFile(path.Join(tmpdirPath, specName))
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.TrimSpace(fileBytes)) == 0 {
+		return "", ErrDockerfileEmpty
+	}
+
+	ops, err := fe.Parse(fileBytes)
+	if err != nil {
+		return "", err
+	}
+
+	defer b.clearTmp(b.tmpContainers)
+
+	total := len(ops)
+	stageName := ""
+	for i, op := range ops {
+		instruction, args := op.Instruction, b.expandEnv(op.Args)
+
+		if instruction == "from" && b.targetReached {
+			// The Target stage's own instructions have all run; stop
+			// before a later stage's FROM starts a new one.
+			return b.image, nil
+		}
+
+		fmt.Fprintf(b.outStream, "Step %d : %s %s\n", i+1, strings.ToUpper(instruction), args)
+
+		startedAt := time.Now()
+		b.lastCacheHitDigest = ""
+		stepInstruction := strings.ToUpper(instruction) + " " + args
+		b.reportProgress(b.stepEvent(i+1, total, stepInstruction, "started", startedAt))
+
+		dispatch, exists := dispatchers[instruction]
+		if !exists {
+			err := fmt.Errorf("Unknown instruction: %s", strings.ToUpper(instruction))
+			event := b.stepEvent(i+1, total, stepInstruction, "error", startedAt)
+			event.ErrorMessage = err.Error()
+			b.reportProgress(event)
+			return "", err
+		}
+		if err := dispatch(b, args); err != nil {
+			event := b.stepEvent(i+1, total, stepInstruction, "error", startedAt)
+			event.ErrorMessage = err.Error()
+			b.reportProgress(event)
+			return "", err
+		}
+
+		// Keep the current stage's entry in stageImages pointing at its
+		// latest image, so a later `COPY --from` sees what the stage built.
+		if instruction == "from" {
+			stageName = b.currentStageName(args)
+		}
+		if stageName != "" {
+			b.stageImages[stageName] = b.image
+			b.stageImages[strconv.Itoa(b.stageIndex-1)] = b.image
+		}
+
+		fmt.Fprintf(b.outStream, " ---> %s\n", utils.TruncateID(b.image))
+		event := b.stepEvent(i+1, total, stepInstruction, "complete", startedAt)
+		event.CachedFromDigest = b.lastCacheHitDigest
+		event.ResultImageID = b.image
+		b.reportProgress(event)
+
+		if instruction == "from" && b.Target != "" && b.currentStageName(args) == b.Target {
+			b.targetReached = true
+		}
+	}
+
+	if b.Target != "" && !b.targetReached {
+		return "", fmt.Errorf("failed to reach build target %s in Dockerfile", b.Target)
+	}
+
+	if b.image == "" {
+		return "", fmt.Errorf("No image was generated. This may be because the Dockerfile does not, like, do anything.\n")
+	}
+	return b.image, nil
+}
+
+// SetTarget restricts Build to stop once the named stage has been
+// committed, instead of running to the end of the Dockerfile.
+func (b *buildFile) SetTarget(name string) {
+	b.Target = name
+}
+
+// currentStageName extracts the `AS <stage>` name from a FROM instruction's
+// arguments, if any.
+func (b *buildFile) currentStageName(fromArgs string) string {
+	fields := strings.Fields(fromArgs)
+	if len(fields) == 3 && strings.EqualFold(fields[1], "as") {
+		return fields[2]
+	}
+	return strconv.Itoa(b.stageIndex - 1)
+}
+
+// expandEnv substitutes $VAR and ${VAR} references from the build-time
+// environment (as built up by ENV instructions) into an instruction's
+// arguments.
+func (b *buildFile) expandEnv(args string) string {
+	if b.config == nil {
+		return args
+	}
+	return os.Expand(args, func(name string) string {
+		for _, envVar := range b.config.Env {
+			parts := strings.SplitN(envVar, "=", 2)
+			if parts[0] == name {
+				return parts[1]
+			}
+		}
+		return ""
+	})
+}
+
+// CmdFrom implements the FROM instruction, optionally tagging the resulting
+// stage with a name via `AS <stage>` so later stages can reference it.
+func (b *buildFile) CmdFrom(name string) error {
+	stageName := ""
+	if fields := strings.Fields(name); len(fields) == 3 && strings.EqualFold(fields[1], "as") {
+		name = fields[0]
+		stageName = fields[2]
+	}
+
+	image, err := b.runtime.repositories.LookupImage(name)
+	if err != nil {
+		if b.runtime.graph.IsNotExist(err) {
+			// Pull it, same as the original implementation.
+			remote, tag := utils.ParseRepositoryTag(name)
+			pullRegistryAuth := b.authConfig
+			if len(b.configFile.Configs) > 0 {
+				// The request came with a registry name in it
+				if strings.Contains(remote, "/") {
+					if firstSlash := strings.Index(remote, "/"); firstSlash != -1 {
+						if _, found := b.configFile.Configs[remote[:firstSlash]]; found {
+							pullRegistryAuth = registry.ResolveAuthConfig(b.configFile, remote[:firstSlash])
+						}
+					}
+				}
+			}
+			job := b.srv.Eng.Job("pull", remote, tag)
+			job.SetenvBool("json", b.sf.Json())
+			job.SetenvBool("parallel", true)
+			job.SetenvJson("authConfig", pullRegistryAuth)
+			job.Stdout.Add(b.outStream)
+			if err := job.Run(); err != nil {
+				return err
+			}
+			image, err = b.runtime.repositories.LookupImage(name)
+			if err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+	b.image = image.ID
+	b.config = &runconfig.Config{}
+	if image.Config != nil {
+		*b.config = *image.Config
+	}
+	if b.config.Env == nil || len(b.config.Env) == 0 {
+		b.config.Env = append(b.config.Env, "HOME=/", "PATH="+DefaultPathEnv)
+	}
+
+	b.stageIndex++
+	if stageName != "" {
+		b.stageImages[stageName] = b.image
+	}
+	b.stageImages[strconv.Itoa(b.stageIndex-1)] = b.image
+
+	// If this FROM starts the stage named by `Target`, Build() lets the
+	// rest of this stage's instructions run and stops just before the
+	// following stage's FROM (see targetReached).
+	return nil
+}
+
+func (b *buildFile) CmdMaintainer(name string) error {
+	b.maintainer = name
+	comment := fmt.Sprintf("MAINTAINER %s", name)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdRun(args string) error {
+	if b.image == "" {
+		return fmt.Errorf("Please provide a source image with `from` prior to run")
+	}
+	config, _, _, err := runconfig.Parse(append([]string{b.image}, b.buildCmdFromJSONOrShell(args)...), nil)
+	if err != nil {
+		return err
+	}
+
+	cmd := b.config.Cmd
+	b.config.Cmd = config.Cmd
+	runconfig.Merge(b.config, config)
+
+	defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
+
+	utils.Debugf("Command to be executed: %v", b.config.Cmd)
+
+	digest := b.stepDigest(fmt.Sprintf("RUN %v", b.config.Cmd), "")
+	hit, err := b.probeCache(digest)
+	if err != nil {
+		return err
+	}
+	if hit {
+		return nil
+	}
+
+	cid, err := b.run()
+	if err != nil {
+		return err
+	}
+	if err := b.commit(cid, cmd, "run", digest); err != nil {
+		return err
+	}
+	return nil
+}
+
+// buildCmdFromJSONOrShell supports both `RUN ["a", "b"]` and `RUN a b` forms.
+func (b *buildFile) buildCmdFromJSONOrShell(args string) []string {
+	if len(args) > 0 && args[0] == '[' {
+		var parsed []string
+		if err := json.Unmarshal([]byte(args), &parsed); err == nil {
+			return parsed
+		}
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+func (b *buildFile) CmdEnv(args string) error {
+	tmp := strings.SplitN(args, " ", 2)
+	if len(tmp) != 2 {
+		return fmt.Errorf("Invalid ENV format")
+	}
+	key := strings.Trim(tmp[0], " \t")
+	value := strings.Trim(tmp[1], " \t")
+
+	comment := fmt.Sprintf("ENV %s=%s", key, value)
+	for i, envVar := range b.config.Env {
+		envParts := strings.SplitN(envVar, "=", 2)
+		if envParts[0] == key {
+			b.config.Env[i] = key + "=" + value
+			return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+		}
+	}
+	b.config.Env = append(b.config.Env, key+"="+value)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdUser(name string) error {
+	b.config.User = name
+	comment := fmt.Sprintf("USER %v", name)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdWorkdir(workdir string) error {
+	b.config.WorkingDir = workdir
+	comment := fmt.Sprintf("WORKDIR %v", workdir)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdVolume(args string) error {
+	if args == "" {
+		return fmt.Errorf("Volume cannot be empty")
+	}
+	var volume []string
+	if err := json.Unmarshal([]byte(args), &volume); err != nil {
+		volume = []string{args}
+	}
+	if b.config.Volumes == nil {
+		b.config.Volumes = map[string]struct{}{}
+	}
+	for _, v := range volume {
+		b.config.Volumes[v] = struct{}{}
+	}
+	comment := fmt.Sprintf("VOLUME %s", args)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdExpose(args string) error {
+	ports := strings.Split(args, " ")
+	b.config.PortSpecs = append(ports, b.config.PortSpecs...)
+	comment := fmt.Sprintf("EXPOSE %v", args)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+func (b *buildFile) CmdCmd(args string) error {
+	cmd := b.buildCmdFromJSONOrShell(args)
+	b.config.Cmd = cmd
+	comment := fmt.Sprintf("CMD %v", cmd)
+	if err := b.commit("", b.config.Cmd, comment, b.stepDigest(comment, "")); err != nil {
+		return err
+	}
+	b.cmdSet = true
+	return nil
+}
+
+func (b *buildFile) CmdEntrypoint(args string) error {
+	entrypoint := b.buildCmdFromJSONOrShell(args)
+	b.config.Entrypoint = entrypoint
+	if !b.cmdSet {
+		b.config.Cmd = nil
+	}
+	comment := fmt.Sprintf("ENTRYPOINT %v", entrypoint)
+	return b.commit("", b.config.Cmd, comment, b.stepDigest(comment, ""))
+}
+
+// addOrCopy implements both ADD and COPY. When args starts with a stage
+// reference (`--from=<stage>`), the source path is resolved against a
+// temporary container created from that stage's image instead of the build
+// context.
+func (b *buildFile) addOrCopy(args string, allowRemote bool) error {
+	if b.context == "" {
+		return fmt.Errorf("No context given. Impossible to use ADD")
+	}
+	orig, dest, from, err := parseAddArgs(args)
+	if err != nil {
+		return err
+	}
+
+	var rootPath string
+	if from != "" {
+		stageImage, ok := b.stageImages[from]
+		if !ok {
+			return fmt.Errorf("no such stage: %s", from)
+		}
+		extracted, cleanup, err := b.extractStage(stageImage)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		rootPath = extracted
+		allowRemote = false
+	} else {
+		rootPath = b.contextPath
+	}
+
+	if !allowRemote && (strings.HasPrefix(orig, "http://") || strings.HasPrefix(orig, "https://")) {
+		return fmt.Errorf("COPY does not support remote URLs, use ADD instead")
+	}
+
+	if strings.HasPrefix(orig, "http://") || strings.HasPrefix(orig, "https://") {
+		return b.addRemote(orig, dest)
+	}
+	return b.addLocal(rootPath, orig, dest, from == "")
+}
+
+func (b *buildFile) CmdAdd(args string) error {
+	return b.addOrCopy(args, true)
+}
+
+func (b *buildFile) CmdCopy(args string) error {
+	return b.addOrCopy(args, false)
+}
+
+// parseAddArgs splits `[--from=<stage>] <src>... <dst>` into its parts.
+func parseAddArgs(args string) (orig, dest, from string, err error) {
+	fields := strings.Fields(args)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "--from=") {
+		from = strings.TrimPrefix(fields[0], "--from=")
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return "", "", "", fmt.Errorf("Invalid ADD/COPY format")
+	}
+	return fields[0], fields[1], from, nil
+}
+
+// ignoreChecker returns a function that reports whether a path relative to
+// base (eg. an ADD source directory) is excluded by the build context's
+// .dockerignore, by translating it back to a context-root-relative path
+// before matching. isDir reports whether relToBase itself is a directory,
+// so directory-only patterns don't also exclude a same-named file.
+func (b *buildFile) ignoreChecker(base string) func(relToBase string, isDir bool) bool {
+	if len(b.ignorePatterns) == 0 {
+		return func(string, bool) bool { return false }
+	}
+	baseRelToContext, err := filepath.Rel(b.contextPath, base)
+	if err != nil {
+		baseRelToContext = "."
+	}
+	return func(relToBase string, isDir bool) bool {
+		full := relToBase
+		if baseRelToContext != "." {
+			full = filepath.Join(baseRelToContext, relToBase)
+		}
+		ignored, _ := dockerignore.Matches(full, isDir, b.ignorePatterns)
+		return ignored
+	}
+}
+
+// filteredCopy stages a copy of srcRoot into a temporary directory with
+// every path excluded by ignore skipped, so ADD/COPY never materializes
+// .dockerignore'd files into the image.
+func filteredCopy(srcRoot string, ignore func(relToBase string, isDir bool) bool) (string, func(), error) {
+	tmp, err := ioutil.TempDir("", "docker-add-filtered")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+
+	err = filepath.Walk(srcRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcRoot, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if ignore(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(tmp, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return copyFileContents(p, target, info.Mode())
+	})
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp, cleanup, nil
+}
+
+func copyFileContents(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// addLocal copies orig (resolved against rootPath) into dest. applyIgnore
+// is false for a `COPY --from=<stage>` source, since .dockerignore only
+// ever governs reads from the build context, not a prior stage's rootfs.
+func (b *buildFile) addLocal(rootPath, orig, dest string, applyIgnore bool) error {
+	cleanRoot := filepath.Clean(rootPath)
+	cleanOrig := filepath.Clean(path.Join(cleanRoot, orig))
+	if p, err := filepath.EvalSymlinks(cleanOrig); err == nil {
+		cleanOrig = p
+	}
+	if !strings.HasPrefix(cleanOrig, cleanRoot) {
+		return fmt.Errorf("Forbidden path outside the build context: %s (%s)", orig, cleanOrig)
+	}
+	info, err := os.Stat(cleanOrig)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such file or directory", orig)
+	} else if err != nil {
+		return err
+	}
+
+	ignore := func(string, bool) bool { return false }
+	if applyIgnore {
+		ignore = b.ignoreChecker(cleanOrig)
+	}
+	fileDigest, err := cache.FileDigestFiltered(cleanOrig, ignore)
+	if err != nil {
+		return err
+	}
+	comment := fmt.Sprintf("ADD %s in %s", orig, dest)
+	digest := b.stepDigest(comment, fileDigest)
+
+	hit, err := b.probeCache(digest)
+	if err != nil {
+		return err
+	}
+	if hit {
+		return nil
+	}
+
+	container, _, err := b.runtime.Create(b.config, "")
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+
+	copySrc := cleanOrig
+	if info.IsDir() && applyIgnore && len(b.ignorePatterns) > 0 {
+		filtered, cleanup, err := filteredCopy(cleanOrig, ignore)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		copySrc = filtered
+	}
+
+	if err := archive.CopyWithTar(copySrc, path.Join(container.RootfsPath(), dest)); err != nil {
+		return err
+	}
+	return b.commit(container.ID, b.config.Cmd, comment, digest)
+}
+
+func (b *buildFile) addRemote(orig, dest string) error {
+	// Remote sources don't have a local merkle digest to key the cache on;
+	// fall back to keying on the URL and destination, as before.
+	comment := fmt.Sprintf("ADD %s in %s", orig, dest)
+	digest := b.stepDigest(comment, "")
+
+	if hit, err := b.probeCache(digest); err != nil {
+		return err
+	} else if hit {
+		return nil
+	}
+
+	resp, err := http.Get(orig)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	container, _, err := b.runtime.Create(b.config, "")
+	if err != nil {
+		return err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+
+	destPath := path.Join(container.RootfsPath(), dest)
+	if strings.HasSuffix(dest, "/") {
+		u, _ := url.Parse(orig)
+		destPath = path.Join(destPath, path.Base(u.Path))
+	}
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return b.commit(container.ID, b.config.Cmd, comment, digest)
+}
+
+// extractStage materializes a prior stage's filesystem by creating a
+// temporary container from its image, so COPY --from can read out of it.
+func (b *buildFile) extractStage(image string) (rootPath string, cleanup func(), err error) {
+	container, _, err := b.runtime.Create(&runconfig.Config{Image: image}, "")
+	if err != nil {
+		return "", nil, err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+	return container.RootfsPath(), func() {}, nil
+}
+
+func (b *buildFile) run() (string, error) {
+	if b.image == "" {
+		return "", fmt.Errorf("Please provide a source image with `from` prior to run")
+	}
+	b.config.Image = b.image
+
+	container, _, err := b.runtime.Create(b.config, "")
+	if err != nil {
+		return "", err
+	}
+	b.tmpContainers[container.ID] = struct{}{}
+	fmt.Fprintf(b.outStream, " ---> Running in %s\n", utils.TruncateID(container.ID))
+
+	if err := container.Start(); err != nil {
+		return "", err
+	}
+	if ret := container.Wait(); ret != 0 {
+		return "", &utils.JSONError{
+			Message: fmt.Sprintf("The command %v returned a non-zero code: %d", b.config.Cmd, ret),
+			Code:    ret,
+		}
+	}
+	return container.ID, nil
+}
+
+// stepDigest computes the content-addressable key for the step about to be
+// run: the current parent image, the canonicalized instruction, and, for
+// ADD/COPY steps, fileDigest (the merkle digest of the exact bytes and
+// modes being added). Pass "" for fileDigest on steps that don't add files.
+func (b *buildFile) stepDigest(instruction, fileDigest string) string {
+	return cache.StepDigest(b.image, instruction, fileDigest)
+}
+
+// probeCache returns true if digest is a cache hit, and if so, applies the
+// cache rather than executing the step.
+func (b *buildFile) probeCache(digest string) (bool, error) {
+	if !b.utilizeCache {
+		return false, nil
+	}
+	imageID, ok := b.cacheStore.Lookup(digest)
+	if !ok {
+		return false, nil
+	}
+	if image, err := b.runtime.graph.Get(imageID); err != nil || image == nil {
+		return false, nil
+	}
+	fmt.Fprintf(b.outStream, " ---> Using cache\n")
+	utils.Debugf("[BUILDER] Use cached version")
+	b.image = imageID
+	b.lastCacheHitDigest = digest
+	return true, nil
+}
+
+// commit runs (or reuses, via digest) the step associated with id/comment
+// and records the resulting image under digest for future cache lookups.
+func (b *buildFile) commit(id string, autoCmd []string, comment, digest string) error {
+	if b.image == "" {
+		return fmt.Errorf("Please provide a source image with `from` prior to commit")
+	}
+	b.config.Image = b.image
+	if id == "" {
+		cmd := b.config.Cmd
+		b.config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + comment}
+		defer func(cmd []string) { b.config.Cmd = cmd }(cmd)
+
+		hit, err := b.probeCache(digest)
+		if err != nil {
+			return err
+		}
+		if hit {
+			return nil
+		}
+
+		container, warnings, err := b.runtime.Create(b.config, "")
+		if err != nil {
+			return err
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(b.outStream, " ---> [Warning] %s\n", warning)
+		}
+		b.tmpContainers[container.ID] = struct{}{}
+		fmt.Fprintf(b.outStream, " ---> Running in %s\n", utils.TruncateID(container.ID))
+		id = container.ID
+	}
+
+	container := b.runtime.Get(id)
+	if container == nil {
+		return fmt.Errorf("An error occurred while creating the container")
+	}
+
+	b.config.Cmd = autoCmd
+	image, err := b.runtime.Commit(container, "", "", "", b.maintainer, b.config)
+	if err != nil {
+		return err
+	}
+	b.tmpImages[image.ID] = struct{}{}
+	b.image = image.ID
+	b.cacheStore.Set(digest, image.ID)
+	if b.lastDigest != "" {
+		b.parentDigest[digest] = b.lastDigest
+	}
+	b.lastDigest = digest
+	return nil
+}
+
+// ImportCache pulls the content-addressable build cache (see builder/cache)
+// from a remote HTTP endpoint and merges it into this build's cache, so
+// later steps can hit cache entries produced by other builds or hosts.
+// Every referenced image layer that is not already present locally is
+// downloaded and loaded (see fetchCacheLayer) before ImportCache returns;
+// layers are not fetched lazily as the build consults them.
+func (b *buildFile) ImportCache(url string) error {
+	resp, err := http.Get(strings.TrimRight(url, "/") + "/manifest")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ImportCache: remote cache returned %s", resp.Status)
+	}
+
+	manifest, err := cache.DecodeManifest(resp.Body)
+	if err != nil {
+		return err
+	}
+	b.cacheStore.Import(manifest)
+
+	for _, entry := range manifest.Entries {
+		if image, err := b.runtime.graph.Get(entry.ImageID); err == nil && image != nil {
+			continue
+		}
+		if err := b.fetchCacheLayer(url, entry.ImageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchCacheLayer materializes imageID locally by downloading its tarball
+// from a remote build cache and loading it the same way `docker load` would.
+func (b *buildFile) fetchCacheLayer(remoteURL, imageID string) error {
+	resp, err := http.Get(strings.TrimRight(remoteURL, "/") + "/layers/" + imageID + ".tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ImportCache: missing layer %s on remote cache", imageID)
+	}
+
+	job := b.srv.Eng.Job("image_load")
+	job.Stdin.Add(resp.Body)
+	return job.Run()
+}
+
+// ExportCache pushes this build's content-addressable cache, and the image
+// layers it references, to a remote HTTP endpoint so other hosts can import
+// it with ImportCache.
+func (b *buildFile) ExportCache(url string) error {
+	manifest := b.cacheStore.Export(b.parentDigest)
+
+	for _, entry := range manifest.Entries {
+		if err := b.pushCacheLayer(url, entry.ImageID); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cache.EncodeManifest(&buf, manifest); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", strings.TrimRight(url, "/")+"/manifest", &buf)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("ExportCache: remote cache returned %s", resp.Status)
+	}
+	return nil
+}
+
+// pushCacheLayer uploads imageID's tarball to a remote build cache, the
+// same way `docker save` would produce it.
+func (b *buildFile) pushCacheLayer(remoteURL, imageID string) error {
+	r, w := io.Pipe()
+	job := b.srv.Eng.Job("image_export", imageID)
+	job.Stdout.Add(w)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- job.Run()
+		w.Close()
+	}()
+
+	req, err := http.NewRequest("PUT", strings.TrimRight(remoteURL, "/")+"/layers/"+imageID+".tar", r)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := <-errc; err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("ExportCache: remote cache returned %s for layer %s", resp.Status, imageID)
+	}
+	return nil
+}
+
+// MkBuildContext turns a Dockerfile plus a set of extra files into a tar
+// archive suitable for use as a build context.
+func MkBuildContext(dockerfile string, files [][2]string) (archive.Archive, error) {
+	return MkBuildContextWithSpec("Dockerfile", dockerfile, files)
+}
+
+// MkBuildContextWithSpec is like MkBuildContext, but allows the build spec to
+// be stored under an arbitrary name (eg. "Dockerfile.json" to exercise the
+// JSON frontend) so its syntax doesn't have to be the default Dockerfile one.
+func MkBuildContextWithSpec(specName, spec string, files [][2]string) (archive.Archive, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, pair := range [][2]string{{specName, spec}} {
+		name, content := pair[0], pair[1]
+		if err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Size: int64(len(content)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	for _, pair := range files {
+		name, content := pair[0], pair[1]
+		if err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Size: int64(len(content)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// buildCaches holds one content-addressable build cache per Runtime, so
+// successive builds against the same runtime share their cache entries.
+var (
+	buildCachesMu sync.Mutex
+	buildCaches   = make(map[*Runtime]*cache.Store)
+)
+
+// NewBuildFile returns a BuildFile ready to run a single build.
+func NewBuildFile(srv *Server, outStream, errStream io.Writer, verbose, utilizeCache, rm bool, outOld io.Writer, sf *utils.StreamFormatter, auth *registry.AuthConfig, progress ProgressReporter) BuildFile {
+	buildCachesMu.Lock()
+	store, ok := buildCaches[srv.runtime]
+	if !ok {
+		store = cache.New()
+		buildCaches[srv.runtime] = store
+	}
+	buildCachesMu.Unlock()
+
+	return &buildFile{
+		runtime:       srv.runtime,
+		srv:           srv,
+		config:        &runconfig.Config{},
+		outStream:     outStream,
+		errStream:     errStream,
+		tmpContainers: make(map[string]struct{}),
+		tmpImages:     make(map[string]struct{}),
+		verbose:       verbose,
+		utilizeCache:  utilizeCache,
+		rm:            rm,
+		sf:            sf,
+		authConfig:    auth,
+		configFile:    &registry.ConfigFile{},
+		stageImages:   make(map[string]string),
+		cacheStore:    store,
+		parentDigest:  make(map[string]string),
+		progress:      progress,
+	}
+}
@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// BuildProgressEvent describes the outcome of a single build step, for
+// consumers (CI systems, IDEs) that want to render progress or post-mortem
+// timings programmatically instead of scraping the human-readable output.
+type BuildProgressEvent struct {
+	Step             int       `json:"step"`
+	Total            int       `json:"total"`
+	Instruction      string    `json:"instruction"`
+	Status           string    `json:"status"` // "started", "complete", or "error"
+	StartedAt        time.Time `json:"startedAt"`
+	DurationMs       int64     `json:"durationMs"`
+	CachedFromDigest string    `json:"cachedFromDigest,omitempty"`
+	ResultImageID    string    `json:"resultImageID,omitempty"`
+	ErrorMessage     string    `json:"errorMessage,omitempty"`
+}
+
+// ProgressReporter receives one BuildProgressEvent per build step, in
+// addition to the existing utils.StreamFormatter-based output written to
+// outStream. NewBuildFile accepts nil to disable it.
+type ProgressReporter interface {
+	Report(event BuildProgressEvent) error
+}
+
+// JSONProgressReporter JSON-encodes each event, one per line, to w.
+type JSONProgressReporter struct {
+	enc *json.Encoder
+}
+
+// NewJSONProgressReporter returns a ProgressReporter that writes one
+// JSON-encoded BuildProgressEvent per line to w.
+func NewJSONProgressReporter(w io.Writer) *JSONProgressReporter {
+	return &JSONProgressReporter{enc: json.NewEncoder(w)}
+}
+
+func (r *JSONProgressReporter) Report(event BuildProgressEvent) error {
+	return r.enc.Encode(event)
+}
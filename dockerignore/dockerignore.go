@@ -0,0 +1,27 @@
+// Package dockerignore implements gitignore-style pattern matching for the
+// `.dockerignore` file honored by the build context.
+package dockerignore
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// ReadAll reads the patterns out of a .dockerignore file, skipping blank
+// lines and comments (lines starting with '#').
+func ReadAll(reader io.Reader) ([]string, error) {
+	if reader == nil {
+		return nil, nil
+	}
+	var excludes []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		excludes = append(excludes, pattern)
+	}
+	return excludes, scanner.Err()
+}
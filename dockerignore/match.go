@@ -0,0 +1,84 @@
+package dockerignore
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matches reports whether path (slash-separated, relative to the build
+// context root) is excluded by patterns. isDir reports whether path itself
+// is a directory, so that a directory-only pattern doesn't also exclude a
+// plain file of the same name. Patterns follow gitignore syntax: a leading
+// "!" negates a previous match, a trailing "/" restricts the pattern to
+// directories, and "**" matches across directory boundaries. As in
+// .gitignore, later patterns take precedence over earlier ones.
+func Matches(path string, isDir bool, patterns []string) (bool, error) {
+	path = filepath.ToSlash(path)
+	excluded := false
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		re, err := patternToRegexp(pattern)
+		if err != nil {
+			return false, err
+		}
+
+		match := false
+		if dirOnly && !isDir {
+			// A directory-only pattern never matches a plain file by its
+			// own name, but still excludes every file under a matching
+			// directory.
+			if i := strings.LastIndex(path, "/"); i >= 0 {
+				match = re.MatchString(path[:i])
+			}
+		} else {
+			match = re.MatchString(path)
+		}
+		if match {
+			excluded = !negate
+		}
+	}
+	return excluded, nil
+}
+
+// patternToRegexp converts a single gitignore-style glob into a regexp that
+// matches it and everything below it.
+func patternToRegexp(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var out strings.Builder
+	out.WriteString("^")
+	if !anchored && !strings.Contains(pattern, "/") {
+		out.WriteString("(?:.*/)?")
+	}
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		rest := string(runes[i:])
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			out.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(rest, "**"):
+			out.WriteString(".*")
+			i++
+		case runes[i] == '*':
+			out.WriteString("[^/]*")
+		case runes[i] == '?':
+			out.WriteString("[^/]")
+		default:
+			out.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	out.WriteString("(?:/.*)?$")
+	return regexp.Compile(out.String())
+}
@@ -24,6 +24,16 @@ func mkTestContext(dockerfile string, files [][2]string, t *testing.T) archive.A
 	return context
 }
 
+// mkTestContextWithSpec is like mkTestContext, but stores the spec under an
+// arbitrary name so alternative BuildFrontends (eg. JSON) can be exercised.
+func mkTestContextWithSpec(specName, spec string, files [][2]string, t *testing.T) archive.Archive {
+	context, err := docker.MkBuildContextWithSpec(specName, spec, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context
+}
+
 // A testContextTemplate describes a build context and how to test it
 type testContextTemplate struct {
 	// Contents of the Dockerfile
@@ -225,6 +235,30 @@ run    [ "$(cat /bar/withfile)" = "test2" ]
 	},
 }
 
+// testJSONContexts mirrors a subset of testContexts expressed through the
+// JSON frontend instead of the shell-style Dockerfile syntax, to prove the
+// two are semantically equivalent.
+var testJSONContexts = []testContextTemplate{
+	{
+		`{"steps": [
+			{"instruction": "from", "args": "{IMAGE}"},
+			{"instruction": "env", "args": "FOO BAR"},
+			{"instruction": "run", "args": "[ \"$FOO\" = \"BAR\" ]"}
+		]}`,
+		nil,
+		nil,
+	},
+}
+
+func TestBuildJSONFrontend(t *testing.T) {
+	for _, ctx := range testJSONContexts {
+		_, err := buildImage(ctx, t, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // FIXME: test building with 2 successive overlapping ADD commands
 
 func constructDockerfile(template string, ip net.IP, port string) string {
@@ -296,8 +330,20 @@ func buildImage(context testContextTemplate, t *testing.T, eng *engine.Engine, u
 	}
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, useCache, false, ioutil.Discard, utils.NewStreamFormatter(false), nil)
-	id, err := buildfile.Build(mkTestContext(dockerfile, context.files, t))
+	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, useCache, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+
+	// A build spec whose first non-space byte is '{' is fed to the JSON
+	// frontend instead of the default shell-style Dockerfile one; this lets
+	// testJSONContexts reuse the exact same buildImage/checkCacheBehavior
+	// plumbing as the Dockerfile-syntax testContexts.
+	var buildContext archive.Archive
+	if strings.HasPrefix(strings.TrimSpace(dockerfile), "{") {
+		buildContext = mkTestContextWithSpec("Dockerfile.json", dockerfile, context.files, t)
+	} else {
+		buildContext = mkTestContext(dockerfile, context.files, t)
+	}
+
+	id, err := buildfile.Build(buildContext)
 	if err != nil {
 		return nil, err
 	}
@@ -579,6 +625,173 @@ func TestBuildADDLocalFileWithCache(t *testing.T) {
 	}
 }
 
+// TestBuildADDLocalFileCacheIgnoresMtime proves that the content-addressable
+// cache keys ADD/COPY steps on file bytes and modes, not mtimes: each build
+// unpacks its context into a new temporary directory, and identical file
+// content there must still hit the cache, while changed content must miss.
+func TestBuildADDLocalFileCacheIgnoresMtime(t *testing.T) {
+	template := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add foo /usr/lib/bla/bar
+        `,
+		[][2]string{{"foo", "hello"}},
+		nil}
+
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+
+	id1 := checkCacheBehaviorFromEngime(t, template, true, eng)
+
+	// Same content, unpacked into a new working tree: still a hit.
+	template.files = [][2]string{{"foo", "hello"}}
+	id2 := checkCacheBehaviorFromEngime(t, template, true, eng)
+	if id1 != id2 {
+		t.Fatal("identical file content across working trees should still hit the cache")
+	}
+
+	// Different content: must miss.
+	template.files = [][2]string{{"foo", "hello world"}}
+	id3 := checkCacheBehaviorFromEngime(t, template, false, eng)
+	if id2 == id3 {
+		t.Fatal("changed file content should invalidate the cache")
+	}
+}
+
+// TestBuildDockerignoreCache proves that a .dockerignore'd sibling file
+// doesn't influence the cache digest: adding (or changing) an ignored file
+// alongside a `COPY . /src/` must still hit the cache.
+func TestBuildDockerignoreCache(t *testing.T) {
+	template := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add . /src/
+        run [ "$(cat /src/foo)" = "hello" ]
+        `,
+		[][2]string{
+			{".dockerignore", "bar\n"},
+			{"foo", "hello"},
+		},
+		nil}
+
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+
+	id1 := checkCacheBehaviorFromEngime(t, template, true, eng)
+
+	// Add an ignored sibling file: should not invalidate the cache.
+	template.files = append(template.files, [2]string{"bar", "unrelated"})
+	id2 := checkCacheBehaviorFromEngime(t, template, true, eng)
+	if id1 != id2 {
+		t.Fatal("adding a .dockerignore'd file should not invalidate the cache")
+	}
+
+	// Changing the ignored file's content shouldn't invalidate it either.
+	template.files[2][1] = "unrelated2"
+	id3 := checkCacheBehaviorFromEngime(t, template, true, eng)
+	if id2 != id3 {
+		t.Fatal("changing a .dockerignore'd file should not invalidate the cache")
+	}
+}
+
+// TestBuildDockerignoreDirOnly verifies that a directory-only pattern
+// ("build/") excludes a directory of that name but leaves a plain file of
+// the same name alone.
+func TestBuildDockerignoreDirOnly(t *testing.T) {
+	dirTemplate := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add . /src/
+        run [ ! -e /src/build ]
+        `,
+		[][2]string{
+			{".dockerignore", "build/\n"},
+			{"build/keep", "hello"},
+		},
+		nil}
+	if _, err := buildImage(dirTemplate, t, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	fileTemplate := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add . /src/
+        run [ "$(cat /src/build)" = "hello" ]
+        `,
+		[][2]string{
+			{".dockerignore", "build/\n"},
+			{"build", "hello"},
+		},
+		nil}
+	if _, err := buildImage(fileTemplate, t, nil, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBuildDockerignoreNegation verifies that a later "!" pattern
+// re-includes a path excluded by an earlier one.
+func TestBuildDockerignoreNegation(t *testing.T) {
+	template := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add . /src/
+        run [ ! -e /src/foo.txt ]
+        run [ "$(cat /src/keep.txt)" = "hello" ]
+        `,
+		[][2]string{
+			{".dockerignore", "*.txt\n!keep.txt\n"},
+			{"foo.txt", "excluded"},
+			{"keep.txt", "hello"},
+		},
+		nil}
+	if _, err := buildImage(template, t, nil, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBuildDockerignoreDoubleStar verifies that "**" matches across
+// directory boundaries at any depth.
+func TestBuildDockerignoreDoubleStar(t *testing.T) {
+	template := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        add . /src/
+        run [ ! -e /src/a/b/c/ignored.log ]
+        run [ "$(cat /src/a/b/c/keep.txt)" = "hello" ]
+        `,
+		[][2]string{
+			{".dockerignore", "**/*.log\n"},
+			{"a/b/c/ignored.log", "excluded"},
+			{"a/b/c/keep.txt", "hello"},
+		},
+		nil}
+	if _, err := buildImage(template, t, nil, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBuildDockerignoreNotAppliedAcrossStages verifies that a `.dockerignore`
+// pattern matching a path in the main build context does not spuriously
+// exclude a same-named file when it's copied in via `COPY --from=<stage>`,
+// since .dockerignore only ever governs reads from the build context.
+func TestBuildDockerignoreNotAppliedAcrossStages(t *testing.T) {
+	template := testContextTemplate{`
+        from {IMAGE} as builder
+        run sh -c 'mkdir -p /stage && echo hello > /stage/keep.txt'
+        from {IMAGE}
+        copy --from=builder /stage /dst/
+        run [ "$(cat /dst/keep.txt)" = "hello" ]
+        `,
+		[][2]string{
+			{".dockerignore", "keep.txt\n"},
+		},
+		nil}
+	if _, err := buildImage(template, t, nil, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestBuildADDLocalFileWithoutCache(t *testing.T) {
 	template := testContextTemplate{`
         from {IMAGE}
@@ -666,6 +879,91 @@ func TestBuildADDLocalAndRemoteFilesWithoutCache(t *testing.T) {
 	checkCacheBehavior(t, template, false)
 }
 
+// mkCacheServer serves a minimal builder/cache remote: GET/PUT /manifest and
+// GET/PUT /layers/<id>.tar, all backed by an in-memory map.
+func mkCacheServer() *httptest.Server {
+	var manifest []byte
+	layers := map[string][]byte{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			manifest, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Write(manifest)
+	})
+	mux.HandleFunc("/layers/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/layers/"), ".tar")
+		if r.Method == "PUT" {
+			layers[name], _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if data, ok := layers[name]; ok {
+			w.Write(data)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return httptest.NewServer(mux)
+}
+
+// TestBuildRemoteCacheImportExport builds once against a fresh engine while
+// exporting the content-addressable cache to a local httptest.Server, tears
+// that engine down, then builds the same Dockerfile against a brand new
+// engine that imports the cache first. The two builds must resolve to the
+// same final image, proving the second one ran entirely from the
+// remote cache rather than re-executing RUN instructions.
+func TestBuildRemoteCacheImportExport(t *testing.T) {
+	cacheSrv := mkCacheServer()
+	defer cacheSrv.Close()
+
+	template := testContextTemplate{`
+        from {IMAGE}
+        maintainer dockerio
+        run echo "first"
+        `,
+		nil, nil}
+
+	eng1 := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng1, t))
+	srv1 := mkServerFromEngine(eng1, t)
+
+	buildfile1 := docker.NewBuildFile(srv1, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+	id1, err := buildfile1.Build(mkTestContext(constructDockerfileNoNet(template.dockerfile, unitTestImageID), nil, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buildfile1.ExportCache(cacheSrv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	eng2 := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng2, t))
+	srv2 := mkServerFromEngine(eng2, t)
+
+	buildfile2 := docker.NewBuildFile(srv2, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+	if err := buildfile2.ImportCache(cacheSrv.URL); err != nil {
+		t.Fatal(err)
+	}
+	id2, err := buildfile2.Build(mkTestContext(constructDockerfileNoNet(template.dockerfile, unitTestImageID), nil, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id1 != id2 {
+		t.Fatalf("expected the imported cache to be reused, got different images: %s != %s", id1, id2)
+	}
+}
+
+// constructDockerfileNoNet substitutes {IMAGE} without needing a live
+// network-bound test server, for builds with no ADD/remote steps.
+func constructDockerfileNoNet(template, image string) string {
+	return strings.NewReplacer("{IMAGE}", image).Replace(template)
+}
+
 func TestForbiddenContextPath(t *testing.T) {
 	eng := NewTestEngine(t)
 	defer nuke(mkRuntimeFromEngine(eng, t))
@@ -700,7 +998,7 @@ func TestForbiddenContextPath(t *testing.T) {
 	}
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil)
+	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
 	_, err = buildfile.Build(mkTestContext(dockerfile, context.files, t))
 
 	if err == nil {
@@ -746,7 +1044,7 @@ func TestBuildADDFileNotFound(t *testing.T) {
 	}
 	dockerfile := constructDockerfile(context.dockerfile, ip, port)
 
-	buildfile := docker.NewBuildFile(mkServerFromEngine(eng, t), ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil)
+	buildfile := docker.NewBuildFile(mkServerFromEngine(eng, t), ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
 	_, err = buildfile.Build(mkTestContext(dockerfile, context.files, t))
 
 	if err == nil {
@@ -760,6 +1058,65 @@ func TestBuildADDFileNotFound(t *testing.T) {
 	}
 }
 
+// recordingReporter collects every BuildProgressEvent reported to it.
+type recordingReporter struct {
+	events []docker.BuildProgressEvent
+}
+
+func (r *recordingReporter) Report(event docker.BuildProgressEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+// TestBuildProgressEvents proves that NewBuildFile's ProgressReporter sees a
+// started/complete pair per step, in step order, and that a step served
+// from cache reports a non-empty CachedFromDigest.
+func TestBuildProgressEvents(t *testing.T) {
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+	srv := mkServerFromEngine(eng, t)
+
+	dockerfile := constructDockerfile(`
+        from {IMAGE}
+        maintainer dockerio
+        run echo "hello"
+        `, eng.Hack_GetGlobalVar("httpapi.bridgeIP").(net.IP), "0")
+
+	// First build populates the cache.
+	first := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+	if _, err := first.Build(mkTestContext(dockerfile, nil, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	reporter := &recordingReporter{}
+	second := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, reporter)
+	if _, err := second.Build(mkTestContext(dockerfile, nil, t)); err != nil {
+		t.Fatal(err)
+	}
+
+	const numSteps = 3 // from, maintainer, run
+	if len(reporter.events) != numSteps*2 {
+		t.Fatalf("expected %d events (started+complete per step), got %d", numSteps*2, len(reporter.events))
+	}
+
+	sawCacheHit := false
+	for i := 0; i < numSteps; i++ {
+		started, complete := reporter.events[i*2], reporter.events[i*2+1]
+		if started.Step != i+1 || complete.Step != i+1 {
+			t.Fatalf("events out of order at step %d: %+v / %+v", i+1, started, complete)
+		}
+		if started.Status != "started" || complete.Status != "complete" {
+			t.Fatalf("unexpected statuses at step %d: %q / %q", i+1, started.Status, complete.Status)
+		}
+		if complete.CachedFromDigest != "" {
+			sawCacheHit = true
+		}
+	}
+	if !sawCacheHit {
+		t.Fatal("expected at least one step to report a non-empty CachedFromDigest on the fully-cached rebuild")
+	}
+}
+
 func TestBuildInheritance(t *testing.T) {
 	eng := NewTestEngine(t)
 	defer nuke(mkRuntimeFromEngine(eng, t))
@@ -815,6 +1172,110 @@ func TestBuildFails(t *testing.T) {
 	}
 }
 
+// TestBuildMultiStageTarget exercises multiple FROM/AS stages in a single
+// Dockerfile and a COPY --from referencing an earlier, named stage; the
+// build runs to the final stage (TestBuildMultiStageTargetStop covers
+// stopping early with SetTarget).
+func TestBuildMultiStageTarget(t *testing.T) {
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+
+	template := testContextTemplate{`
+        from {IMAGE} as builder
+        run sh -c 'echo hello > /out'
+        from {IMAGE}
+        copy --from=builder /out /out
+        run [ "$(cat /out)" = "hello" ]
+        `,
+		nil, nil}
+
+	img, err := buildImage(template, t, eng, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ID == "" {
+		t.Fatal("expected a final-stage image ID")
+	}
+}
+
+// TestBuildMultiStageTargetStop verifies that SetTarget stops the build
+// right after the named stage's own instructions have run, without
+// executing any later stage (the later stage's RUN fails the build if it
+// is ever executed).
+func TestBuildMultiStageTargetStop(t *testing.T) {
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+	srv := mkServerFromEngine(eng, t)
+
+	dockerfile := constructDockerfileNoNet(`
+        from {IMAGE} as builder
+        run sh -c 'echo hello > /out'
+        run [ "$(cat /out)" = "hello" ]
+        from {IMAGE}
+        run sh -c 'echo unreached > /out && exit 1'
+        `, unitTestImageID)
+
+	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+	buildfile.SetTarget("builder")
+
+	id, err := buildfile.Build(mkTestContext(dockerfile, nil, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := srv.ImageInspect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ID == "" {
+		t.Fatal("expected the builder stage's image to be returned")
+	}
+}
+
+// TestBuildMultiStageTargetUnknown verifies that SetTarget with a stage
+// name that never appears in the Dockerfile fails the build instead of
+// silently running to completion.
+func TestBuildMultiStageTargetUnknown(t *testing.T) {
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+	srv := mkServerFromEngine(eng, t)
+
+	dockerfile := constructDockerfileNoNet(`
+        from {IMAGE} as builder
+        run sh -c 'echo hello > /out'
+        `, unitTestImageID)
+
+	buildfile := docker.NewBuildFile(srv, ioutil.Discard, ioutil.Discard, false, true, false, ioutil.Discard, utils.NewStreamFormatter(false), nil, nil)
+	buildfile.SetTarget("no-such-stage")
+
+	if _, err := buildfile.Build(mkTestContext(dockerfile, nil, t)); err == nil {
+		t.Fatal("expected an error for a target that never appears in the Dockerfile")
+	}
+}
+
+// TestBuildMultiStageCache verifies that mutating an earlier stage
+// invalidates the image produced by a later stage that copies from it.
+func TestBuildMultiStageCache(t *testing.T) {
+	eng := NewTestEngine(t)
+	defer nuke(mkRuntimeFromEngine(eng, t))
+
+	mkTemplate := func(content string) testContextTemplate {
+		return testContextTemplate{fmt.Sprintf(`
+        from {IMAGE} as builder
+        run sh -c 'echo %s > /out'
+        from {IMAGE}
+        copy --from=builder /out /out
+        `, content),
+			nil, nil}
+	}
+
+	id1 := checkCacheBehaviorFromEngime(t, mkTemplate("hello"), true, eng)
+	id2 := checkCacheBehaviorFromEngime(t, mkTemplate("world"), false, eng)
+	if id1 == id2 {
+		t.Fatal("changing the builder stage should invalidate the final stage's cache")
+	}
+}
+
 func TestBuildFailsDockerfileEmpty(t *testing.T) {
 	_, err := buildImage(testContextTemplate{``, nil, nil}, t, nil, true)
 